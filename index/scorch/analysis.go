@@ -0,0 +1,45 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scorch
+
+import (
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/index"
+)
+
+// analyzeDocument runs each of d's indexed fields through its analyzer
+// and returns the resulting *index.AnalysisResult, the form every
+// segment format (zap included) actually persists. It is a plain
+// function, not a *Scorch method, because it touches no index state -
+// Builder uses it directly to avoid needing a real, opened index just
+// to analyze documents offline.
+func analyzeDocument(d index.Document) *index.AnalysisResult {
+	rv := &index.AnalysisResult{
+		DocID:    d.ID(),
+		Document: d,
+		Analyzed: make([]analysis.TokenFrequencies, len(d.Fields())),
+		Length:   make([]int, len(d.Fields())),
+	}
+
+	for i, field := range d.Fields() {
+		if field.Options().IsIndexed() {
+			fieldLength, tokenFreqs := field.Analyze()
+			rv.Analyzed[i] = tokenFreqs
+			rv.Length[i] = fieldLength
+		}
+	}
+
+	return rv
+}
@@ -0,0 +1,58 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scorch
+
+import (
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/index/scorch/segment/zap"
+)
+
+// Builder is a scorch-level wrapper around zap.Builder. It lets callers
+// assemble a single on-disk segment for an entire index directly from a
+// stream of documents, bypassing scorch's normal incremental
+// introduce/merge cycle. This is intended for offline, bulk-load
+// scenarios where the index does not need to be queryable while it is
+// being built; the resulting segment can be opened as the sole segment
+// of a fresh scorch index once Close returns.
+//
+// zap.Builder (and the on-disk format it writes) only ever deals in
+// already-analyzed documents, the same as the rest of scorch's
+// introduce path, so Index runs each document through analyzeDocument
+// before handing it down.
+type Builder struct {
+	builder *zap.Builder
+}
+
+// NewBuilder creates a Builder that will write its final segment to
+// path once Close is called. batchSize and mergeMax are forwarded to
+// zap.NewBuilder; see its documentation for their meaning.
+func NewBuilder(path string, batchSize, mergeMax int) (*Builder, error) {
+	zb, err := zap.NewBuilder(path, batchSize, mergeMax)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Builder{builder: zb}, nil
+}
+
+// Index analyzes doc and adds the result to the Builder.
+func (b *Builder) Index(doc index.Document) error {
+	return b.builder.Index(analyzeDocument(doc))
+}
+
+// Close finishes building the segment at path.
+func (b *Builder) Close() error {
+	return b.builder.Close()
+}
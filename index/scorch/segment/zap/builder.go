@@ -0,0 +1,211 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/blevesearch/bleve/index"
+)
+
+// DefaultBuilderBatchSize is the default number of documents a Builder
+// buffers in memory before flushing them to an intermediate on-disk
+// segment.
+const DefaultBuilderBatchSize = 1000
+
+// DefaultBuilderMergeMax is the default number of intermediate segments
+// a Builder allows to accumulate before folding them together via
+// Merge.
+const DefaultBuilderMergeMax = 10
+
+// builderChunkFactor is the chunk factor used for segments (both
+// intermediate and final) produced by a Builder.
+const builderChunkFactor = 1024
+
+// Builder assembles a single zap segment from a stream of already
+// analyzed documents, bypassing the incremental in-memory batch/merge
+// cycle that scorch normally uses while the index is open and
+// queryable. It is meant for offline, bulk-load scenarios where the
+// index does not need to be queryable while it is being constructed:
+// analyzed documents are buffered and flushed to small intermediate
+// segments under a temporary directory, which are folded together
+// with Merge as they accumulate, and merged one final time into the
+// caller-supplied path on Close. Builder does not run the analyzer
+// itself - that is scorch.Builder's job - since newSegmentBase (like
+// the rest of this package) only ever consumes the already-tokenized
+// *index.AnalysisResult form, never a raw index.Document.
+type Builder struct {
+	path      string
+	batchSize int
+	mergeMax  int
+
+	tmpDir  string
+	nextSeg int
+
+	batch    []*index.AnalysisResult
+	segments []string
+}
+
+// NewBuilder creates a Builder that will write its final segment to
+// path once Close is called. batchSize is the number of documents
+// buffered in memory before being flushed to an intermediate segment;
+// mergeMax is the number of intermediate segments allowed to
+// accumulate before they are merged down into one. Values <= 0 select
+// DefaultBuilderBatchSize / DefaultBuilderMergeMax.
+func NewBuilder(path string, batchSize, mergeMax int) (*Builder, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBuilderBatchSize
+	}
+	if mergeMax <= 0 {
+		mergeMax = DefaultBuilderMergeMax
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), ".zap-builder-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Builder{
+		path:      path,
+		batchSize: batchSize,
+		mergeMax:  mergeMax,
+		tmpDir:    tmpDir,
+	}, nil
+}
+
+// Index adds the analyzed doc to the Builder, flushing the in-memory
+// batch to an intermediate segment once batchSize documents have
+// accumulated. doc must already have been run through analysis (see
+// scorch.Builder.Index, which runs it through analyzeDocument before
+// handing the result down here) - this package has no analyzer of its own and
+// works only in terms of the already-tokenized form newSegmentBase
+// expects.
+func (b *Builder) Index(doc *index.AnalysisResult) error {
+	b.batch = append(b.batch, doc)
+	if len(b.batch) < b.batchSize {
+		return nil
+	}
+	return b.flushBatch()
+}
+
+// Close flushes any remaining buffered documents, merges all
+// intermediate segments into the final segment at path, and removes
+// the Builder's temporary directory.
+func (b *Builder) Close() error {
+	defer func() {
+		_ = os.RemoveAll(b.tmpDir)
+	}()
+
+	err := b.flushBatch()
+	if err != nil {
+		return err
+	}
+
+	if len(b.segments) == 0 {
+		sb, _, err := newSegmentBase(nil, builderChunkFactor)
+		if err != nil {
+			return err
+		}
+		return persistSegmentBase(sb, b.path)
+	}
+
+	if len(b.segments) == 1 {
+		return os.Rename(b.segments[0], b.path)
+	}
+
+	return b.mergeInto(b.segments, b.path)
+}
+
+// flushBatch persists the current in-memory batch as a new intermediate
+// segment, then merges down the accumulated intermediate segments once
+// there are mergeMax or more of them.
+func (b *Builder) flushBatch() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+
+	sb, _, err := newSegmentBase(b.batch, builderChunkFactor)
+	if err != nil {
+		return err
+	}
+
+	segPath := b.nextSegmentPath()
+	err = persistSegmentBase(sb, segPath)
+	if err != nil {
+		return err
+	}
+
+	b.batch = b.batch[:0]
+	b.segments = append(b.segments, segPath)
+
+	if len(b.segments) >= b.mergeMax {
+		mergedPath := b.nextSegmentPath()
+		err = b.mergeInto(b.segments, mergedPath)
+		if err != nil {
+			return err
+		}
+		b.segments = []string{mergedPath}
+	}
+
+	return nil
+}
+
+// mergeInto merges the segments found at segPaths into a single new
+// segment at outPath, using the existing Merge machinery, and removes
+// segPaths once the merge succeeds.
+func (b *Builder) mergeInto(segPaths []string, outPath string) error {
+	segs := make([]*Segment, 0, len(segPaths))
+	defer func() {
+		for _, seg := range segs {
+			_ = seg.Close()
+		}
+	}()
+
+	for _, segPath := range segPaths {
+		seg, err := Open(segPath)
+		if err != nil {
+			return err
+		}
+		segs = append(segs, seg.(*Segment))
+	}
+
+	drops := make([]*roaring.Bitmap, len(segs))
+
+	_, _, err := Merge(context.Background(), segs, drops, outPath, builderChunkFactor, MergeOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segs {
+		_ = seg.Close()
+	}
+	segs = nil
+
+	for _, segPath := range segPaths {
+		_ = os.Remove(segPath)
+	}
+
+	return nil
+}
+
+func (b *Builder) nextSegmentPath() string {
+	b.nextSeg++
+	return filepath.Join(b.tmpDir, fmt.Sprintf("%d.zap", b.nextSeg))
+}
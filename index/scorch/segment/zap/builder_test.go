@@ -0,0 +1,110 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zap
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/document"
+	"github.com/blevesearch/bleve/index"
+)
+
+// TestBuilderRoundTrip indexes a handful of documents through a
+// Builder, forcing both an intermediate flush and an intermediate
+// merge well before Close, and checks that the final on-disk segment
+// reports the right document count and reads back each document's
+// stored field unchanged. This exercises newSegmentBase being fed
+// Builder's buffered *index.AnalysisResult batches end to end, rather
+// than just type-checking against it.
+func TestBuilderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "builder-roundtrip.zap")
+
+	// batchSize=2 and mergeMax=2 guarantee at least one flushBatch
+	// and one mergeInto before Close ever runs, for numDocs=9.
+	b, err := NewBuilder(path, 2, 2)
+	if err != nil {
+		t.Fatalf("NewBuilder: %v", err)
+	}
+
+	const numDocs = 9
+	for i := 0; i < numDocs; i++ {
+		doc := document.NewDocument(fmt.Sprintf("doc-%d", i))
+		doc.AddField(document.NewTextFieldWithIndexingOptions("name", nil,
+			[]byte(fmt.Sprintf("value-%d", i)), document.IndexField|document.StoreField))
+		if err := b.Index(testAnalyze(doc)); err != nil {
+			t.Fatalf("Index(%d): %v", i, err)
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	segIface, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = segIface.Close() }()
+
+	seg := segIface.(*Segment)
+	if got := seg.Count(); got != numDocs {
+		t.Fatalf("Count() = %d, want %d", got, numDocs)
+	}
+
+	for i := uint64(0); i < numDocs; i++ {
+		var gotValue string
+		err := seg.VisitDocument(i, func(field string, typ byte, value []byte, pos []uint64) bool {
+			if field == "name" {
+				gotValue = string(value)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("VisitDocument(%d): %v", i, err)
+		}
+
+		want := fmt.Sprintf("value-%d", i)
+		if gotValue != want {
+			t.Fatalf("doc %d field \"name\" = %q, want %q", i, gotValue, want)
+		}
+	}
+}
+
+// testAnalyze is a minimal, test-only copy of scorch's analyzeDocument.
+// It lives here rather than being imported from the scorch package to
+// avoid a zap<->scorch import cycle (scorch.Builder is the one that
+// calls the real analyzeDocument in production).
+func testAnalyze(d index.Document) *index.AnalysisResult {
+	rv := &index.AnalysisResult{
+		DocID:    d.ID(),
+		Document: d,
+		Analyzed: make([]analysis.TokenFrequencies, len(d.Fields())),
+		Length:   make([]int, len(d.Fields())),
+	}
+
+	for i, field := range d.Fields() {
+		if field.Options().IsIndexed() {
+			fieldLength, tokenFreqs := field.Analyze()
+			rv.Analyzed[i] = tokenFreqs
+			rv.Length[i] = fieldLength
+		}
+	}
+
+	return rv
+}
@@ -17,15 +17,17 @@ package zap
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"os"
+	"runtime"
 	"sort"
+	"sync"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/Smerity/govarint"
-	"github.com/couchbase/vellum"
 	"github.com/golang/snappy"
 )
 
@@ -36,9 +38,31 @@ const docDropped = math.MaxUint64 // sentinel docNum to represent a deleted doc
 // Merge takes a slice of zap segments and bit masks describing which
 // documents may be dropped, and creates a new segment containing the
 // remaining data.  This new segment is built at the specified path,
-// with the provided chunkFactor.
-func Merge(segments []*Segment, drops []*roaring.Bitmap, path string,
-	chunkFactor uint32) ([][]uint64, uint64, error) {
+// with the provided chunkFactor. ctx may be used to cancel a
+// long-running merge (e.g. when the index holding it is closing); on
+// cancellation the partially-written output file is removed. options
+// may be the zero value, in which case the registered default segment
+// format is used, no progress is reported, and IO is not throttled.
+//
+// When every input segment shares the same field ordering (the
+// fieldsSame check in mergeFields, which is always true for a single
+// segment being tombstone-compacted), stored docs are copied straight
+// from the source mmap in contiguous, drops-aware byte ranges instead
+// of being decoded and re-compressed - see copyStoredDocs.
+//
+// NOTE: that fast path covers only the stored-fields section. Every
+// field's postings still go through the normal per-term FST rebuild
+// in persistMergedRest, even when no term in the field loses every
+// doc it matched. Skipping that rebuild too, as originally scoped for
+// this change, isn't possible without a deeper change to the on-disk
+// format: compaction renumbers every surviving doc to stay dense
+// (0..newSegDocCount), which invalidates every posting list's encoded
+// doc numbers and byte offsets regardless of whether any individual
+// term's postings became empty. A real FST-skip would need segments
+// to tolerate sparse/tombstoned doc numbers instead of always
+// compacting them away.
+func Merge(ctx context.Context, segments []*Segment, drops []*roaring.Bitmap,
+	path string, chunkFactor uint32, options MergeOptions) ([][]uint64, uint64, error) {
 	flag := os.O_RDWR | os.O_CREATE
 
 	f, err := os.OpenFile(path, flag, 0600)
@@ -57,13 +81,14 @@ func Merge(segments []*Segment, drops []*roaring.Bitmap, path string,
 	}
 
 	// buffer the output
-	br := bufio.NewWriterSize(f, DefaultFileMergerBufferSize)
+	br := bufio.NewWriterSize(newThrottledWriter(f, options.BytesPerSecLimit),
+		DefaultFileMergerBufferSize)
 
 	// wrap it for counting (tracking offsets)
 	cr := NewCountHashWriter(br)
 
 	newDocNums, numDocs, storedIndexOffset, fieldsIndexOffset, docValueOffset, _, _, _, err :=
-		MergeToWriter(segmentBases, drops, chunkFactor, cr)
+		MergeToWriter(ctx, segmentBases, drops, chunkFactor, options, cr)
 	if err != nil {
 		cleanup()
 		return nil, 0, err
@@ -97,27 +122,52 @@ func Merge(segments []*Segment, drops []*roaring.Bitmap, path string,
 	return newDocNums, uint64(cr.Count()), nil
 }
 
-func MergeToWriter(segments []*SegmentBase, drops []*roaring.Bitmap,
-	chunkFactor uint32, cr *CountHashWriter) (
+func MergeToWriter(ctx context.Context, segments []*SegmentBase, drops []*roaring.Bitmap,
+	chunkFactor uint32, options MergeOptions, cr *CountHashWriter) (
+	newDocNums [][]uint64,
+	numDocs, storedIndexOffset, fieldsIndexOffset, docValueOffset uint64,
+	dictLocs []uint64, fieldsInv []string, fieldsMap map[string]uint16,
+	err error) {
+	segVersion := options.SegmentVersion
+	if segVersion == 0 {
+		segVersion = defaultSegmentPlugin.Version()
+	}
+	return MergeToWriterForVersion(ctx, segments, drops, chunkFactor, segVersion, options, cr)
+}
+
+// MergeToWriterForVersion is MergeToWriter, but with the on-disk
+// segment format selected explicitly via segVersion rather than
+// defaulting to the currently registered default SegmentPlugin. This
+// allows segments written by an older, still-registered plugin version
+// to be merged up into a newer version's output format (or vice versa,
+// for experimentation) without a full reindex.
+func MergeToWriterForVersion(ctx context.Context, segments []*SegmentBase, drops []*roaring.Bitmap,
+	chunkFactor, segVersion uint32, options MergeOptions, cr *CountHashWriter) (
 	newDocNums [][]uint64,
 	numDocs, storedIndexOffset, fieldsIndexOffset, docValueOffset uint64,
 	dictLocs []uint64, fieldsInv []string, fieldsMap map[string]uint16,
 	err error) {
 	docValueOffset = uint64(fieldNotUninverted)
 
+	segPlugin := SegmentPluginByVersion(segVersion)
+	if segPlugin == nil {
+		return nil, 0, 0, 0, 0, nil, nil, nil,
+			fmt.Errorf("no segment plugin registered for version %d", segVersion)
+	}
+
 	var fieldsSame bool
 	fieldsSame, fieldsInv = mergeFields(segments)
 	fieldsMap = mapFields(fieldsInv)
 
 	numDocs = computeNewDocCount(segments, drops)
 	if numDocs > 0 {
-		storedIndexOffset, newDocNums, err = mergeStoredAndRemap(segments, drops,
-			fieldsMap, fieldsInv, fieldsSame, numDocs, cr)
+		storedIndexOffset, newDocNums, err = mergeStoredAndRemap(ctx, segments, drops,
+			fieldsMap, fieldsInv, fieldsSame, numDocs, options.ReportProgress, cr)
 		if err != nil {
 			return nil, 0, 0, 0, 0, nil, nil, nil, err
 		}
 
-		dictLocs, docValueOffset, err = persistMergedRest(segments, drops,
+		dictLocs, docValueOffset, err = persistMergedRest(ctx, segPlugin, segments, drops,
 			fieldsInv, fieldsMap, fieldsSame,
 			newDocNums, numDocs, chunkFactor, cr)
 		if err != nil {
@@ -158,239 +208,114 @@ func computeNewDocCount(segments []*SegmentBase, drops []*roaring.Bitmap) uint64
 	return newDocCount
 }
 
-func persistMergedRest(segments []*SegmentBase, dropsIn []*roaring.Bitmap,
-	fieldsInv []string, fieldsMap map[string]uint16, fieldsSame bool,
-	newDocNumsIn [][]uint64, newSegDocCount uint64, chunkFactor uint32,
-	w *CountHashWriter) ([]uint64, uint64, error) {
-
-	var bufMaxVarintLen64 []byte = make([]byte, binary.MaxVarintLen64)
-	var bufLoc []uint64
-
-	var postings *PostingsList
-	var postItr *PostingsIterator
-
-	rv := make([]uint64, len(fieldsInv))
-	fieldDvLocs := make([]uint64, len(fieldsInv))
-
-	tfEncoder := newChunkedIntCoder(uint64(chunkFactor), newSegDocCount-1)
-	locEncoder := newChunkedIntCoder(uint64(chunkFactor), newSegDocCount-1)
-
-	// docTermMap is keyed by docNum, where the array impl provides
-	// better memory usage behavior than a sparse-friendlier hashmap
-	// for when docs have much structural similarity (i.e., every doc
-	// has a given field)
-	var docTermMap [][]byte
-
-	var vellumBuf bytes.Buffer
-	newVellum, err := vellum.New(&vellumBuf, nil)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	newRoaring := roaring.NewBitmap()
-
-	// for each field
-	for fieldID, fieldName := range fieldsInv {
-
-		// collect FST iterators from all active segments for this field
-		var newDocNums [][]uint64
-		var drops []*roaring.Bitmap
-		var dicts []*Dictionary
-		var itrs []vellum.Iterator
-
-		for segmentI, segment := range segments {
-			dict, err2 := segment.dictionary(fieldName)
-			if err2 != nil {
-				return nil, 0, err2
-			}
-			if dict != nil && dict.fst != nil {
-				itr, err2 := dict.fst.Iterator(nil, nil)
-				if err2 != nil && err2 != vellum.ErrIteratorDone {
-					return nil, 0, err2
-				}
-				if itr != nil {
-					newDocNums = append(newDocNums, newDocNumsIn[segmentI])
-					if dropsIn[segmentI] != nil && !dropsIn[segmentI].IsEmpty() {
-						drops = append(drops, dropsIn[segmentI])
-					} else {
-						drops = append(drops, nil)
-					}
-					dicts = append(dicts, dict)
-					itrs = append(itrs, itr)
-				}
-			}
-		}
-
-		if uint64(cap(docTermMap)) < newSegDocCount {
-			docTermMap = make([][]byte, newSegDocCount)
-		} else {
-			docTermMap = docTermMap[0:newSegDocCount]
-			for docNum := range docTermMap { // reset the docTermMap
-				docTermMap[docNum] = docTermMap[docNum][:0]
-			}
-		}
-
-		var prevTerm []byte
-
-		newRoaring.Clear()
-
-		var lastDocNum, lastFreq, lastNorm uint64
+// maxFieldMergeWorkers caps how many fields persistMergedRest merges
+// concurrently. Each worker gets its own Merger (and therefore its own
+// encoders, roaring bitmap, and doc-to-terms map), so this also bounds
+// the extra memory a merge uses over a strictly serial one.
+var maxFieldMergeWorkers = runtime.NumCPU()
 
-		// determines whether to use "1-hit" encoding optimization
-		// when a term appears in only 1 doc, with no loc info,
-		// has freq of 1, and the docNum fits into 31-bits
-		use1HitEncoding := func(termCardinality uint64) (bool, uint64, uint64) {
-			if termCardinality == uint64(1) && locEncoder.FinalSize() <= 0 {
-				docNum := uint64(newRoaring.Minimum())
-				if under32Bits(docNum) && docNum == lastDocNum && lastFreq == 1 {
-					return true, docNum, lastNorm
-				}
-			}
-			return false, 0, 0
-		}
-
-		finishTerm := func(term []byte) error {
-			if term == nil {
-				return nil
-			}
-
-			tfEncoder.Close()
-			locEncoder.Close()
-
-			postingsOffset, err := writePostings(newRoaring,
-				tfEncoder, locEncoder, use1HitEncoding, w, bufMaxVarintLen64)
-			if err != nil {
-				return err
-			}
-
-			if postingsOffset > 0 {
-				err = newVellum.Insert(term, postingsOffset)
-				if err != nil {
-					return err
-				}
-			}
-
-			newRoaring.Clear()
-
-			tfEncoder.Reset()
-			locEncoder.Reset()
-
-			lastDocNum = 0
-			lastFreq = 0
-			lastNorm = 0
-
-			return nil
-		}
-
-		enumerator, err := newEnumerator(itrs)
-
-		for err == nil {
-			term, itrI, postingsOffset := enumerator.Current()
-
-			if !bytes.Equal(prevTerm, term) {
-				// if the term changed, write out the info collected
-				// for the previous term
-				err2 := finishTerm(prevTerm)
-				if err2 != nil {
-					return nil, 0, err2
-				}
-			}
+type fieldMergeJob struct {
+	fieldID   int
+	fieldName string
+}
 
-			var err2 error
-			postings, err2 = dicts[itrI].postingsListFromOffset(
-				postingsOffset, drops[itrI], postings)
-			if err2 != nil {
-				return nil, 0, err2
-			}
+type fieldMergeResult struct {
+	fieldID int
+	merged  interface{}
+	err     error
+}
 
-			postItr = postings.iterator(postItr)
-
-			if fieldsSame {
-				// can optimize by copying freq/norm/loc bytes directly
-				lastDocNum, lastFreq, lastNorm, err = mergeTermFreqNormLocsByCopying(
-					term, postItr, newDocNums[itrI], newRoaring,
-					tfEncoder, locEncoder, docTermMap)
-			} else {
-				lastDocNum, lastFreq, lastNorm, bufLoc, err = mergeTermFreqNormLocs(
-					fieldsMap, term, postItr, newDocNums[itrI], newRoaring,
-					tfEncoder, locEncoder, docTermMap, bufLoc)
-			}
-			if err != nil {
-				return nil, 0, err
+// persistMergedRest merges every field's postings and doc values using
+// up to maxFieldMergeWorkers goroutines, each running a separate
+// Merger, and then stitches the merged fields into w sequentially, in
+// fieldID order, via Merger.WriteField. Running the term-enumeration
+// and encoding work concurrently is what makes this worthwhile: it is
+// the dominant cost of a large merge, and on a multi-core machine with
+// many fields it previously left most of those cores idle.
+func persistMergedRest(ctx context.Context, segPlugin SegmentPlugin, segments []*SegmentBase,
+	dropsIn []*roaring.Bitmap, fieldsInv []string, fieldsMap map[string]uint16,
+	fieldsSame bool, newDocNumsIn [][]uint64, newSegDocCount uint64,
+	chunkFactor uint32, w *CountHashWriter) ([]uint64, uint64, error) {
+
+	numWorkers := maxFieldMergeWorkers
+	if numWorkers > len(fieldsInv) {
+		numWorkers = len(fieldsInv)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	jobs := make(chan fieldMergeJob)
+	results := make(chan fieldMergeResult, len(fieldsInv))
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		merger := segPlugin.NewMerger(segments, dropsIn, fieldsMap, fieldsSame, chunkFactor)
+
+		wg.Add(1)
+		go func(merger Merger) {
+			defer wg.Done()
+			for job := range jobs {
+				merged, err := merger.MergeField(ctx, job.fieldID, job.fieldName,
+					newDocNumsIn, newSegDocCount)
+				results <- fieldMergeResult{fieldID: job.fieldID, merged: merged, err: err}
 			}
+		}(merger)
+	}
 
-			prevTerm = prevTerm[:0] // copy to prevTerm in case Next() reuses term mem
-			prevTerm = append(prevTerm, term...)
-
-			err = enumerator.Next()
+	go func() {
+		for fieldID, fieldName := range fieldsInv {
+			jobs <- fieldMergeJob{fieldID: fieldID, fieldName: fieldName}
 		}
-		if err != nil && err != vellum.ErrIteratorDone {
-			return nil, 0, err
-		}
-
-		err = finishTerm(prevTerm)
-		if err != nil {
-			return nil, 0, err
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	mergedFields := make([]interface{}, len(fieldsInv))
+	var firstErr error
+	for res := range results {
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
 		}
+		mergedFields[res.fieldID] = res.merged
+	}
+	if firstErr != nil {
+		discardMergedFields(segPlugin, segments, dropsIn, fieldsMap, fieldsSame, chunkFactor, mergedFields)
+		return nil, 0, firstErr
+	}
 
-		dictOffset := uint64(w.Count())
+	// a fresh Merger is enough to stitch every field: WriteField only
+	// touches the already-merged data handed to it, not the Merger's
+	// own per-field scratch state
+	stitcher := segPlugin.NewMerger(segments, dropsIn, fieldsMap, fieldsSame, chunkFactor)
 
-		err = newVellum.Close()
-		if err != nil {
-			return nil, 0, err
-		}
-		vellumData := vellumBuf.Bytes()
+	rv := make([]uint64, len(fieldsInv))
+	fieldDvLocs := make([]uint64, len(fieldsInv))
 
-		// write out the length of the vellum data
-		n := binary.PutUvarint(bufMaxVarintLen64, uint64(len(vellumData)))
-		_, err = w.Write(bufMaxVarintLen64[:n])
-		if err != nil {
+	for fieldID := range fieldsInv {
+		if err := ctx.Err(); err != nil {
+			discardMergedFields(segPlugin, segments, dropsIn, fieldsMap, fieldsSame, chunkFactor, mergedFields[fieldID:])
 			return nil, 0, err
 		}
 
-		// write this vellum to disk
-		_, err = w.Write(vellumData)
+		dictOffset, dvOffset, err := stitcher.WriteField(mergedFields[fieldID], w)
 		if err != nil {
+			// WriteField's own defer already discarded mergedFields[fieldID]
+			discardMergedFields(segPlugin, segments, dropsIn, fieldsMap, fieldsSame, chunkFactor, mergedFields[fieldID+1:])
 			return nil, 0, err
 		}
 
 		rv[fieldID] = dictOffset
-
-		// update the field doc values
-		fdvEncoder := newChunkedContentCoder(uint64(chunkFactor), newSegDocCount-1)
-		for docNum, docTerms := range docTermMap {
-			if len(docTerms) > 0 {
-				err = fdvEncoder.Add(uint64(docNum), docTerms)
-				if err != nil {
-					return nil, 0, err
-				}
-			}
-		}
-		err = fdvEncoder.Close()
-		if err != nil {
-			return nil, 0, err
-		}
-
-		// get the field doc value offset
-		fieldDvLocs[fieldID] = uint64(w.Count())
-
-		// persist the doc value details for this field
-		_, err = fdvEncoder.Write(w)
-		if err != nil {
-			return nil, 0, err
-		}
-
-		// reset vellum buffer and vellum builder
-		vellumBuf.Reset()
-		err = newVellum.Reset(&vellumBuf)
-		if err != nil {
-			return nil, 0, err
-		}
+		fieldDvLocs[fieldID] = dvOffset
 	}
 
 	fieldDvLocsOffset := uint64(w.Count())
 
-	buf := bufMaxVarintLen64
+	buf := make([]byte, binary.MaxVarintLen64)
 	for _, offset := range fieldDvLocs {
 		n := binary.PutUvarint(buf, uint64(offset))
 		_, err := w.Write(buf[:n])
@@ -402,6 +327,24 @@ func persistMergedRest(segments []*SegmentBase, dropsIn []*roaring.Bitmap,
 	return rv, fieldDvLocsOffset, nil
 }
 
+// discardMergedFields releases any resources (e.g. a spilled temp
+// file) held by entries of mergedFields that were produced by a prior
+// MergeField call but will never reach WriteField, because
+// persistMergedRest is bailing out early - a sibling field's merge
+// failed, or ctx was cancelled partway through stitching. Without
+// this, those fields' temp files would never be cleaned up: WriteField
+// only ever runs (and closes its own field's file) on the fields
+// reached before the early return.
+func discardMergedFields(segPlugin SegmentPlugin, segments []*SegmentBase, dropsIn []*roaring.Bitmap,
+	fieldsMap map[string]uint16, fieldsSame bool, chunkFactor uint32, mergedFields []interface{}) {
+	discarder := segPlugin.NewMerger(segments, dropsIn, fieldsMap, fieldsSame, chunkFactor)
+	for _, mergedField := range mergedFields {
+		if mergedField != nil {
+			discarder.DiscardField(mergedField)
+		}
+	}
+}
+
 func mergeTermFreqNormLocs(fieldsMap map[string]uint16, term []byte, postItr *PostingsIterator,
 	newDocNums []uint64, newRoaring *roaring.Bitmap,
 	tfEncoder *chunkedIntCoder, locEncoder *chunkedIntCoder, docTermMap [][]byte,
@@ -498,58 +441,9 @@ func mergeTermFreqNormLocsByCopying(term []byte, postItr *PostingsIterator,
 	return lastDocNum, lastFreq, lastNorm, err
 }
 
-func writePostings(postings *roaring.Bitmap, tfEncoder, locEncoder *chunkedIntCoder,
-	use1HitEncoding func(uint64) (bool, uint64, uint64),
-	w *CountHashWriter, bufMaxVarintLen64 []byte) (
-	offset uint64, err error) {
-	termCardinality := postings.GetCardinality()
-	if termCardinality <= 0 {
-		return 0, nil
-	}
-
-	if use1HitEncoding != nil {
-		encodeAs1Hit, docNum1Hit, normBits1Hit := use1HitEncoding(termCardinality)
-		if encodeAs1Hit {
-			return FSTValEncode1Hit(docNum1Hit, normBits1Hit), nil
-		}
-	}
-
-	tfOffset := uint64(w.Count())
-	_, err = tfEncoder.Write(w)
-	if err != nil {
-		return 0, err
-	}
-
-	locOffset := uint64(w.Count())
-	_, err = locEncoder.Write(w)
-	if err != nil {
-		return 0, err
-	}
-
-	postingsOffset := uint64(w.Count())
-
-	n := binary.PutUvarint(bufMaxVarintLen64, tfOffset)
-	_, err = w.Write(bufMaxVarintLen64[:n])
-	if err != nil {
-		return 0, err
-	}
-
-	n = binary.PutUvarint(bufMaxVarintLen64, locOffset)
-	_, err = w.Write(bufMaxVarintLen64[:n])
-	if err != nil {
-		return 0, err
-	}
-
-	_, err = writeRoaringWithLen(postings, w, bufMaxVarintLen64)
-	if err != nil {
-		return 0, err
-	}
-
-	return postingsOffset, nil
-}
-
-func mergeStoredAndRemap(segments []*SegmentBase, drops []*roaring.Bitmap,
+func mergeStoredAndRemap(ctx context.Context, segments []*SegmentBase, drops []*roaring.Bitmap,
 	fieldsMap map[string]uint16, fieldsInv []string, fieldsSame bool, newSegDocCount uint64,
+	reportProgress func(bytesWritten, docsMerged, totalDocs uint64),
 	w *CountHashWriter) (uint64, [][]uint64, error) {
 	var rv [][]uint64 // The remapped or newDocNums for each segment.
 
@@ -573,18 +467,25 @@ func mergeStoredAndRemap(segments []*SegmentBase, drops []*roaring.Bitmap,
 
 		dropsI := drops[segI]
 
-		// optimize when the field mapping is the same across all
-		// segments and there are no deletions, via byte-copying
-		// of stored docs bytes directly to the writer
-		if fieldsSame && (dropsI == nil || dropsI.GetCardinality() == 0) {
-			err := segment.copyStoredDocs(newDocNum, docNumOffsets, w)
+		// byte-copy fast path; see the Merge doc comment and
+		// copyStoredDocs
+		if fieldsSame {
+			priorDocNum := newDocNum
+
+			var err error
+			newDocNum, err = segment.copyStoredDocs(ctx, newDocNum, docNumOffsets, dropsI,
+				newSegDocCount, reportProgress, w)
 			if err != nil {
 				return 0, nil, err
 			}
 
-			for i := uint64(0); i < segment.numDocs; i++ {
-				segNewDocNums[i] = newDocNum
-				newDocNum++
+			for docNum := uint64(0); docNum < segment.numDocs; docNum++ {
+				if dropsI != nil && dropsI.Contains(uint32(docNum)) {
+					segNewDocNums[docNum] = docDropped
+					continue
+				}
+				segNewDocNums[docNum] = priorDocNum
+				priorDocNum++
 			}
 			rv = append(rv, segNewDocNums)
 
@@ -593,6 +494,10 @@ func mergeStoredAndRemap(segments []*SegmentBase, drops []*roaring.Bitmap,
 
 		// for each doc num
 		for docNum := uint64(0); docNum < segment.numDocs; docNum++ {
+			if err := ctx.Err(); err != nil {
+				return 0, nil, err
+			}
+
 			// TODO: roaring's API limits docNums to 32-bits?
 			if dropsI != nil && dropsI.Contains(uint32(docNum)) {
 				segNewDocNums[docNum] = docDropped
@@ -663,6 +568,10 @@ func mergeStoredAndRemap(segments []*SegmentBase, drops []*roaring.Bitmap,
 			}
 
 			newDocNum++
+
+			if reportProgress != nil {
+				reportProgress(uint64(w.Count()), newDocNum, newSegDocCount)
+			}
 		}
 
 		rv = append(rv, segNewDocNums)
@@ -682,39 +591,73 @@ func mergeStoredAndRemap(segments []*SegmentBase, drops []*roaring.Bitmap,
 	return storedIndexOffset, rv, nil
 }
 
-// copyStoredDocs writes out a segment's stored doc info, optimized by
-// using a single Write() call for the entire set of bytes.  The
-// newDocNumOffsets is filled with the new offsets for each doc.
-func (s *SegmentBase) copyStoredDocs(newDocNum uint64, newDocNumOffsets []uint64,
-	w *CountHashWriter) error {
+// copyStoredDocs writes out a segment's surviving (non-dropped) stored
+// doc info, using a single Write() call per contiguous run of
+// surviving doc nums rather than one per doc - so a segment with no
+// drops at all is copied in one Write(), and a segment with scattered
+// drops still avoids ever decoding and re-compressing a surviving
+// doc's stored fields. newDocNumOffsets is filled with the new offsets
+// for each surviving doc; it returns the newDocNum following the last
+// one written.
+func (s *SegmentBase) copyStoredDocs(ctx context.Context, newDocNum uint64, newDocNumOffsets []uint64,
+	drops *roaring.Bitmap, newSegDocCount uint64,
+	reportProgress func(bytesWritten, docsMerged, totalDocs uint64),
+	w *CountHashWriter) (uint64, error) {
 	if s.numDocs <= 0 {
-		return nil
+		return newDocNum, nil
 	}
 
-	indexOffset0, storedOffset0, _, _, _ :=
-		s.getDocStoredOffsets(0) // the segment's first doc
+	for rangeStart := uint64(0); rangeStart < s.numDocs; {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 
-	indexOffsetN, storedOffsetN, readN, metaLenN, dataLenN :=
-		s.getDocStoredOffsets(s.numDocs - 1) // the segment's last doc
+		if drops != nil && drops.Contains(uint32(rangeStart)) {
+			rangeStart++
+			continue
+		}
 
-	storedOffset0New := uint64(w.Count())
+		// extend the range over as many immediately-following
+		// surviving docs as possible, so they're all copied with a
+		// single Write() below
+		rangeEnd := rangeStart
+		for rangeEnd+1 < s.numDocs &&
+			(drops == nil || !drops.Contains(uint32(rangeEnd+1))) {
+			rangeEnd++
+		}
 
-	storedBytes := s.mem[storedOffset0 : storedOffsetN+readN+metaLenN+dataLenN]
-	_, err := w.Write(storedBytes)
-	if err != nil {
-		return err
-	}
+		indexOffset0, storedOffset0, _, _, _ :=
+			s.getDocStoredOffsets(rangeStart) // the range's first doc
+
+		indexOffsetN, storedOffsetN, readN, metaLenN, dataLenN :=
+			s.getDocStoredOffsets(rangeEnd) // the range's last doc
+
+		storedOffset0New := uint64(w.Count())
+
+		storedBytes := s.mem[storedOffset0 : storedOffsetN+readN+metaLenN+dataLenN]
+		_, err := w.Write(storedBytes)
+		if err != nil {
+			return 0, err
+		}
+
+		// remap the storedOffset's for the docs into new offsets
+		// relative to storedOffset0New, filling the given
+		// newDocNumOffsets array
+		for indexOffset := indexOffset0; indexOffset <= indexOffsetN; indexOffset += 8 {
+			storedOffset := binary.BigEndian.Uint64(s.mem[indexOffset : indexOffset+8])
+			storedOffsetNew := storedOffset - storedOffset0 + storedOffset0New
+			newDocNumOffsets[newDocNum] = storedOffsetNew
+			newDocNum++
+		}
+
+		if reportProgress != nil {
+			reportProgress(uint64(w.Count()), newDocNum, newSegDocCount)
+		}
 
-	// remap the storedOffset's for the docs into new offsets relative
-	// to storedOffset0New, filling the given docNumOffsetsOut array
-	for indexOffset := indexOffset0; indexOffset <= indexOffsetN; indexOffset += 8 {
-		storedOffset := binary.BigEndian.Uint64(s.mem[indexOffset : indexOffset+8])
-		storedOffsetNew := storedOffset - storedOffset0 + storedOffset0New
-		newDocNumOffsets[newDocNum] = storedOffsetNew
-		newDocNum += 1
+		rangeStart = rangeEnd + 1
 	}
 
-	return nil
+	return newDocNum, nil
 }
 
 // mergeFields builds a unified list of fields used across all the
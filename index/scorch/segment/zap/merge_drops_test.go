@@ -0,0 +1,95 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zap
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// TestMergeSingleSegmentWithDropsRoundTrip merges a single segment
+// against a non-empty drops bitmap (see copyStoredDocs) and checks
+// that every surviving doc, and only the surviving docs, reads back
+// correctly from the merged output, in their original relative order.
+func TestMergeSingleSegmentWithDropsRoundTrip(t *testing.T) {
+	segs := buildTestMergeSegments(t, 10)
+
+	// fold the 10 single-doc segments into one segment first, so
+	// there's a single multi-doc SegmentBase to apply drops against
+	dir := t.TempDir()
+	onePath := filepath.Join(dir, "one.zap")
+
+	noDrops := make([]*roaring.Bitmap, len(segs))
+
+	_, _, err := Merge(context.Background(), segs, noDrops, onePath, builderChunkFactor, MergeOptions{})
+	if err != nil {
+		t.Fatalf("Merge (concatenate): %v", err)
+	}
+
+	oneIface, err := Open(onePath)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", onePath, err)
+	}
+	defer func() { _ = oneIface.Close() }()
+	one := oneIface.(*Segment)
+
+	// drop the odd-numbered docs
+	drops := roaring.NewBitmap()
+	for docNum := uint32(1); docNum < 10; docNum += 2 {
+		drops.Add(docNum)
+	}
+
+	mergedPath := filepath.Join(dir, "merged.zap")
+	_, _, err = Merge(context.Background(), []*Segment{one}, []*roaring.Bitmap{drops},
+		mergedPath, builderChunkFactor, MergeOptions{})
+	if err != nil {
+		t.Fatalf("Merge (with drops): %v", err)
+	}
+
+	mergedIface, err := Open(mergedPath)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", mergedPath, err)
+	}
+	defer func() { _ = mergedIface.Close() }()
+	merged := mergedIface.(*Segment)
+
+	const wantCount = 5
+	if got := merged.Count(); got != wantCount {
+		t.Fatalf("Count() = %d, want %d", got, wantCount)
+	}
+
+	for newDocNum := uint64(0); newDocNum < wantCount; newDocNum++ {
+		origDocNum := newDocNum * 2 // only even-numbered docs survived
+		var gotValue string
+		err := merged.VisitDocument(newDocNum, func(field string, typ byte, value []byte, pos []uint64) bool {
+			if field == "name" {
+				gotValue = string(value)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("VisitDocument(%d): %v", newDocNum, err)
+		}
+
+		want := fmt.Sprintf("name-%d", origDocNum)
+		if gotValue != want {
+			t.Fatalf("merged doc %d field \"name\" = %q, want %q", newDocNum, gotValue, want)
+		}
+	}
+}
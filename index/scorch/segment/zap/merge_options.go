@@ -0,0 +1,86 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zap
+
+import (
+	"io"
+	"time"
+)
+
+// MergeOptions carries the optional, cross-cutting knobs for a Merge /
+// MergeToWriter call: how to report progress, and how hard to throttle
+// the merge's IO so it doesn't starve concurrent query traffic.
+type MergeOptions struct {
+	// SegmentVersion, when non-zero, selects an explicit on-disk
+	// segment format version rather than the registered default. See
+	// MergeToWriterForVersion.
+	SegmentVersion uint32
+
+	// ReportProgress, when non-nil, is invoked during the stored-doc
+	// remap phase of the merge (mergeStoredAndRemap / copyStoredDocs)
+	// with the cumulative bytes written so far, the number of stored
+	// docs copied or re-encoded so far, and the total number of
+	// documents the merge will produce. It is not called during the
+	// postings/FST merge phase (persistMergedRest), which for a large
+	// merge is typically most of the remaining work after
+	// docsMerged reaches totalDocs.
+	ReportProgress func(bytesWritten, docsMerged, totalDocs uint64)
+
+	// BytesPerSecLimit, when non-zero, caps the rate at which the
+	// merge writes to its output file. This bounds the IO impact of a
+	// background merge during peak query load, at the cost of a
+	// longer-running merge.
+	BytesPerSecLimit uint64
+}
+
+// throttledWriter wraps an io.Writer, sleeping as needed so that writes
+// average no more than bytesPerSec bytes per second.
+type throttledWriter struct {
+	w            io.Writer
+	bytesPerSec  uint64
+	windowStart  time.Time
+	windowWrites uint64
+}
+
+func newThrottledWriter(w io.Writer, bytesPerSec uint64) io.Writer {
+	if bytesPerSec <= 0 {
+		return w
+	}
+	return &throttledWriter{w: w, bytesPerSec: bytesPerSec, windowStart: time.Now()}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n <= 0 {
+		return n, err
+	}
+
+	t.windowWrites += uint64(n)
+
+	elapsed := time.Since(t.windowStart)
+	allowed := time.Duration(float64(t.windowWrites) / float64(t.bytesPerSec) * float64(time.Second))
+	if allowed > elapsed {
+		time.Sleep(allowed - elapsed)
+	}
+
+	// once a full second's worth of budget has passed, start a fresh
+	// accounting window so windowWrites/elapsed don't grow without bound
+	if time.Since(t.windowStart) >= time.Second {
+		t.windowStart = time.Now()
+		t.windowWrites = 0
+	}
+
+	return n, err
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zap
+
+import (
+	"context"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// SegmentPlugin describes a pluggable on-disk zap segment format. The
+// term-enumeration loop, the postings/FST encoding step, and the
+// docvalues encoder (MergeField / WriteField) are written against
+// this interface rather than against a single hard-coded roaring-bitmap
+// postings encoding and vellum FST, so that:
+//
+//   - alternative postings/doc-value encodings can be developed and
+//     measured side by side with the current format, and
+//   - a segment version can be upgraded by merging segments written by
+//     an older, compatible plugin into a newer plugin's output format,
+//     without requiring a full reindex.
+//
+// Stored-doc persistence (mergeStoredAndRemap / copyStoredDocs) is
+// deliberately left out of this interface: the stored-doc section's
+// layout (varint meta + snappy-compressed field values, indexed by a
+// flat docNum -> offset table) has never varied across on-disk
+// versions the way postings/dict encodings have, so it stays a single
+// plugin-agnostic implementation in merge.go rather than per-plugin
+// surface area with no current second implementation to justify it.
+//
+// Register a plugin with RegisterSegmentPlugin; the first plugin
+// registered becomes the default used by Merge and MergeToWriter.
+type SegmentPlugin interface {
+	// Version reports the on-disk segment format version this plugin
+	// reads and writes.
+	Version() uint32
+
+	// NewMerger returns a Merger that combines segments (which must all
+	// be readable by this plugin). A Merger's MergeField is safe to
+	// call concurrently from multiple goroutines, each working on a
+	// different field, as long as each goroutine uses its own Merger
+	// instance (one per worker, not one shared across workers).
+	NewMerger(segments []*SegmentBase, drops []*roaring.Bitmap,
+		fieldsMap map[string]uint16, fieldsSame bool,
+		chunkFactor uint32) Merger
+}
+
+// Merger performs the version-specific work of combining term
+// dictionaries, postings, and doc values for a single field at a time
+// across a set of segments.
+//
+// Merging a field is split into two steps so that the expensive part -
+// term enumeration and postings/doc-value encoding - can run
+// concurrently across fields, while only the cheaper part - appending
+// each field's already-encoded bytes to the single output file in
+// fieldID order and building its term dictionary FST over the
+// resulting offsets - has to run sequentially:
+//
+//  1. MergeField does the term enumeration and encoding, entirely
+//     in memory (or a private temp file), independent of any other
+//     field's merge and of the final output file's current size.
+//  2. WriteField appends a previously merged field to the shared
+//     output writer, fixing up any offsets that were only knowable
+//     once the field's position in that writer was fixed, and builds
+//     and writes the field's term dictionary FST.
+type Merger interface {
+	// MergeField merges postings and doc values for fieldName across
+	// all of the Merger's segments and returns an opaque,
+	// plugin-defined handle to be passed to WriteField. ctx is checked
+	// for cancellation at term-enumeration boundaries so a long field
+	// merge can be interrupted promptly.
+	MergeField(ctx context.Context, fieldID int, fieldName string, newDocNums [][]uint64,
+		newSegDocCount uint64) (mergedField interface{}, err error)
+
+	// WriteField appends mergedField (as produced by a prior MergeField
+	// call, possibly by a different Merger instance for the same
+	// SegmentPlugin) to w, and returns the absolute offset of its term
+	// dictionary and the absolute offset of its doc-values block.
+	WriteField(mergedField interface{}, w *CountHashWriter) (dictOffset, docValuesOffset uint64, err error)
+
+	// DiscardField releases any resources (e.g. a spilled temp file)
+	// held by a mergedField that was produced by MergeField but will
+	// never be passed to WriteField - because persistMergedRest is
+	// bailing out early, a sibling field's merge failed, or ctx was
+	// cancelled mid-stitch. mergedField may be nil.
+	DiscardField(mergedField interface{})
+}
+
+// segmentPlugins holds every SegmentPlugin registered via
+// RegisterSegmentPlugin, keyed by Version().
+var segmentPlugins = map[uint32]SegmentPlugin{}
+
+// defaultSegmentPlugin is the plugin used by Merge and MergeToWriter
+// when no explicit version is requested. It is set to the first
+// plugin registered.
+var defaultSegmentPlugin SegmentPlugin
+
+// RegisterSegmentPlugin makes p available for selection by version via
+// SegmentPluginByVersion / MergeToWriterForVersion.
+func RegisterSegmentPlugin(p SegmentPlugin) {
+	segmentPlugins[p.Version()] = p
+	if defaultSegmentPlugin == nil {
+		defaultSegmentPlugin = p
+	}
+}
+
+// SegmentPluginByVersion returns the plugin registered for the given
+// on-disk segment version, or nil if none is registered.
+func SegmentPluginByVersion(version uint32) SegmentPlugin {
+	return segmentPlugins[version]
+}
+
+func init() {
+	RegisterSegmentPlugin(&v11Plugin{})
+}
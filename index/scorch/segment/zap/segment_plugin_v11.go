@@ -0,0 +1,504 @@
+//  Copyright (c) 2020 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 		http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/couchbase/vellum"
+)
+
+// v11Version is the on-disk segment format version implemented by
+// v11Plugin: chunked int-coded postings, roaring bitmap doc id sets,
+// and vellum (FST) term dictionaries.
+const v11Version uint32 = 11
+
+// v11FieldSpillThreshold is the size, in bytes, past which a field's
+// merged tf/loc payload is spilled to a temp file rather than held
+// in memory. This keeps a merge of many large fields from holding
+// all of their payloads in RAM at once.
+const v11FieldSpillThreshold = 32 * 1024 * 1024
+
+// v11Plugin is the SegmentPlugin for the v11 on-disk zap segment
+// format.
+type v11Plugin struct{}
+
+func (*v11Plugin) Version() uint32 {
+	return v11Version
+}
+
+func (*v11Plugin) NewMerger(segments []*SegmentBase, drops []*roaring.Bitmap,
+	fieldsMap map[string]uint16, fieldsSame bool, chunkFactor uint32) Merger {
+	return &v11Merger{
+		segments:    segments,
+		drops:       drops,
+		fieldsMap:   fieldsMap,
+		fieldsSame:  fieldsSame,
+		chunkFactor: chunkFactor,
+	}
+}
+
+// v11MergedTerm is one term's postings, merged across segments, as
+// collected by v11Merger.MergeField. Everything it carries is either
+// self-contained (roaring, the chunked tf/loc payload bytes) or
+// expressed as an offset relative to the start of that payload, so
+// that it can be handed off to a WriteField call running in a
+// different goroutine, against a writer whose current size isn't
+// known until then.
+type v11MergedTerm struct {
+	term []byte
+
+	// oneHit is set when this term qualifies for the single-hit
+	// fast-path encoding, in which case val is the already fully
+	// encoded FST value and tfOffset/locOffset/roaring are unused.
+	oneHit bool
+	val    uint64
+
+	tfOffset, locOffset uint64 // offsets within the field's payload
+	roaring             []byte // length-prefixed roaring bitmap bytes
+}
+
+// v11FieldMerge is the Merger-opaque handle v11Merger.MergeField
+// returns and v11Merger.WriteField consumes. It holds one field's
+// merged postings and doc values, encoded but not yet written to any
+// particular output file.
+type v11FieldMerge struct {
+	terms []v11MergedTerm
+
+	// payload is the concatenated [tfBytes][locBytes] pairs referenced
+	// by each term's tfOffset/locOffset, held in memory for small
+	// fields and spilled to payloadFile once it exceeds
+	// v11FieldSpillThreshold. payloadSize is its length so far,
+	// regardless of which backing is currently in use.
+	payload     bytes.Buffer
+	payloadFile *os.File
+	payloadSize uint64
+
+	fdv bytes.Buffer // this field's encoded doc-values block
+}
+
+// payloadWrite writes p to the field's payload - in memory, or to a
+// spilled temp file once the payload has grown past
+// v11FieldSpillThreshold - and returns the offset p was written at.
+func (fm *v11FieldMerge) payloadWrite(p []byte) (uint64, error) {
+	if fm.payloadFile == nil && uint64(fm.payload.Len()+len(p)) > v11FieldSpillThreshold {
+		f, err := ioutil.TempFile("", "zap-field-merge-")
+		if err != nil {
+			return 0, err
+		}
+		if fm.payload.Len() > 0 {
+			_, err = f.Write(fm.payload.Bytes())
+			if err != nil {
+				_ = f.Close()
+				return 0, err
+			}
+		}
+		fm.payloadFile = f
+		fm.payload.Reset()
+	}
+
+	offset := fm.payloadSize
+
+	var err error
+	if fm.payloadFile != nil {
+		_, err = fm.payloadFile.Write(p)
+	} else {
+		_, err = fm.payload.Write(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	fm.payloadSize += uint64(len(p))
+
+	return offset, nil
+}
+
+func (fm *v11FieldMerge) closePayloadFile() {
+	if fm.payloadFile == nil {
+		return
+	}
+	_ = fm.payloadFile.Close()
+	_ = os.Remove(fm.payloadFile.Name())
+}
+
+// v11Merger is the v11Plugin's Merger. A v11Merger is intended for use
+// by a single goroutine; callers merging fields concurrently must use
+// one v11Merger per worker goroutine so that each has its own scratch
+// encoders, roaring bitmap, and doc-to-terms map.
+type v11Merger struct {
+	segments    []*SegmentBase
+	drops       []*roaring.Bitmap
+	fieldsMap   map[string]uint16
+	fieldsSame  bool
+	chunkFactor uint32
+
+	bufMaxVarintLen64 []byte
+	bufLoc            []uint64
+
+	tfEncoder  *chunkedIntCoder
+	locEncoder *chunkedIntCoder
+	docTermMap [][]byte
+
+	newRoaring *roaring.Bitmap
+
+	postings *PostingsList
+	postItr  *PostingsIterator
+}
+
+func (m *v11Merger) MergeField(ctx context.Context, _ int, fieldName string,
+	newDocNumsIn [][]uint64, newSegDocCount uint64) (interface{}, error) {
+	if m.bufMaxVarintLen64 == nil {
+		m.bufMaxVarintLen64 = make([]byte, binary.MaxVarintLen64)
+	}
+	if m.tfEncoder == nil {
+		m.tfEncoder = newChunkedIntCoder(uint64(m.chunkFactor), newSegDocCount-1)
+		m.locEncoder = newChunkedIntCoder(uint64(m.chunkFactor), newSegDocCount-1)
+		m.newRoaring = roaring.NewBitmap()
+	}
+
+	tfEncoder := m.tfEncoder
+	locEncoder := m.locEncoder
+	newRoaring := m.newRoaring
+
+	fm := &v11FieldMerge{}
+
+	// collect FST iterators from all active segments for this field
+	var newDocNums [][]uint64
+	var drops []*roaring.Bitmap
+	var dicts []*Dictionary
+	var itrs []vellum.Iterator
+
+	for segmentI, segment := range m.segments {
+		dict, err2 := segment.dictionary(fieldName)
+		if err2 != nil {
+			return nil, err2
+		}
+		if dict != nil && dict.fst != nil {
+			itr, err2 := dict.fst.Iterator(nil, nil)
+			if err2 != nil && err2 != vellum.ErrIteratorDone {
+				return nil, err2
+			}
+			if itr != nil {
+				newDocNums = append(newDocNums, newDocNumsIn[segmentI])
+				if m.drops[segmentI] != nil && !m.drops[segmentI].IsEmpty() {
+					drops = append(drops, m.drops[segmentI])
+				} else {
+					drops = append(drops, nil)
+				}
+				dicts = append(dicts, dict)
+				itrs = append(itrs, itr)
+			}
+		}
+	}
+
+	if uint64(cap(m.docTermMap)) < newSegDocCount {
+		m.docTermMap = make([][]byte, newSegDocCount)
+	} else {
+		m.docTermMap = m.docTermMap[0:newSegDocCount]
+		for docNum := range m.docTermMap { // reset the docTermMap
+			m.docTermMap[docNum] = m.docTermMap[docNum][:0]
+		}
+	}
+	docTermMap := m.docTermMap
+
+	var prevTerm []byte
+
+	newRoaring.Clear()
+
+	var lastDocNum, lastFreq, lastNorm uint64
+
+	// determines whether to use "1-hit" encoding optimization
+	// when a term appears in only 1 doc, with no loc info,
+	// has freq of 1, and the docNum fits into 31-bits
+	use1HitEncoding := func(termCardinality uint64) (bool, uint64, uint64) {
+		if termCardinality == uint64(1) && locEncoder.FinalSize() <= 0 {
+			docNum := uint64(newRoaring.Minimum())
+			if under32Bits(docNum) && docNum == lastDocNum && lastFreq == 1 {
+				return true, docNum, lastNorm
+			}
+		}
+		return false, 0, 0
+	}
+
+	finishTerm := func(term []byte) error {
+		if term == nil {
+			return nil
+		}
+
+		tfEncoder.Close()
+		locEncoder.Close()
+
+		mt, err := m.writeTerm(fm, newRoaring, tfEncoder, locEncoder, use1HitEncoding)
+		if err != nil {
+			return err
+		}
+		if mt != nil {
+			mt.term = append([]byte(nil), term...)
+			fm.terms = append(fm.terms, *mt)
+		}
+
+		newRoaring.Clear()
+
+		tfEncoder.Reset()
+		locEncoder.Reset()
+
+		lastDocNum = 0
+		lastFreq = 0
+		lastNorm = 0
+
+		return nil
+	}
+
+	enumerator, err := newEnumerator(itrs)
+
+	for err == nil {
+		if err := ctx.Err(); err != nil {
+			fm.closePayloadFile()
+			return nil, err
+		}
+
+		term, itrI, postingsOffset := enumerator.Current()
+
+		if !bytes.Equal(prevTerm, term) {
+			// if the term changed, write out the info collected
+			// for the previous term
+			err2 := finishTerm(prevTerm)
+			if err2 != nil {
+				fm.closePayloadFile()
+				return nil, err2
+			}
+		}
+
+		var err2 error
+		m.postings, err2 = dicts[itrI].postingsListFromOffset(
+			postingsOffset, drops[itrI], m.postings)
+		if err2 != nil {
+			fm.closePayloadFile()
+			return nil, err2
+		}
+
+		m.postItr = m.postings.iterator(m.postItr)
+
+		if m.fieldsSame {
+			// can optimize by copying freq/norm/loc bytes directly
+			lastDocNum, lastFreq, lastNorm, err = mergeTermFreqNormLocsByCopying(
+				term, m.postItr, newDocNums[itrI], newRoaring,
+				tfEncoder, locEncoder, docTermMap)
+		} else {
+			lastDocNum, lastFreq, lastNorm, m.bufLoc, err = mergeTermFreqNormLocs(
+				m.fieldsMap, term, m.postItr, newDocNums[itrI], newRoaring,
+				tfEncoder, locEncoder, docTermMap, m.bufLoc)
+		}
+		if err != nil {
+			fm.closePayloadFile()
+			return nil, err
+		}
+
+		prevTerm = prevTerm[:0] // copy to prevTerm in case Next() reuses term mem
+		prevTerm = append(prevTerm, term...)
+
+		err = enumerator.Next()
+	}
+	if err != nil && err != vellum.ErrIteratorDone {
+		fm.closePayloadFile()
+		return nil, err
+	}
+
+	err = finishTerm(prevTerm)
+	if err != nil {
+		fm.closePayloadFile()
+		return nil, err
+	}
+
+	// encode this field's doc values
+	fdvEncoder := newChunkedContentCoder(uint64(m.chunkFactor), newSegDocCount-1)
+	for docNum, docTerms := range docTermMap {
+		if len(docTerms) > 0 {
+			err = fdvEncoder.Add(uint64(docNum), docTerms)
+			if err != nil {
+				fm.closePayloadFile()
+				return nil, err
+			}
+		}
+	}
+	err = fdvEncoder.Close()
+	if err != nil {
+		fm.closePayloadFile()
+		return nil, err
+	}
+	_, err = fdvEncoder.Write(&fm.fdv)
+	if err != nil {
+		fm.closePayloadFile()
+		return nil, err
+	}
+
+	return fm, nil
+}
+
+// writeTerm appends the current term's tf/loc payload (or, for the
+// 1-hit fast path, just records its self-contained FST value) to fm,
+// returning the v11MergedTerm to be recorded once its term bytes are
+// known, or nil if the term's postings were empty.
+func (m *v11Merger) writeTerm(fm *v11FieldMerge, newRoaring *roaring.Bitmap,
+	tfEncoder, locEncoder *chunkedIntCoder,
+	use1HitEncoding func(uint64) (bool, uint64, uint64)) (*v11MergedTerm, error) {
+	termCardinality := newRoaring.GetCardinality()
+	if termCardinality <= 0 {
+		return nil, nil
+	}
+
+	if encodeAs1Hit, docNum1Hit, normBits1Hit := use1HitEncoding(termCardinality); encodeAs1Hit {
+		return &v11MergedTerm{oneHit: true, val: FSTValEncode1Hit(docNum1Hit, normBits1Hit)}, nil
+	}
+
+	var tfBuf, locBuf bytes.Buffer
+	_, err := tfEncoder.Write(&tfBuf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = locEncoder.Write(&locBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	tfOffset, err := fm.payloadWrite(tfBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	locOffset, err := fm.payloadWrite(locBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var roaringBuf bytes.Buffer
+	_, err = writeRoaringWithLen(newRoaring, &roaringBuf, m.bufMaxVarintLen64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v11MergedTerm{
+		tfOffset:  tfOffset,
+		locOffset: locOffset,
+		roaring:   roaringBuf.Bytes(),
+	}, nil
+}
+
+// DiscardField closes and removes mergedField's spilled payload file,
+// if it has one, without ever writing it out. Safe to call with nil.
+func (m *v11Merger) DiscardField(mergedField interface{}) {
+	if fm, ok := mergedField.(*v11FieldMerge); ok {
+		fm.closePayloadFile()
+	}
+}
+
+func (m *v11Merger) WriteField(mergedField interface{}, w *CountHashWriter) (uint64, uint64, error) {
+	fm := mergedField.(*v11FieldMerge)
+	defer fm.closePayloadFile()
+
+	payloadBase := uint64(w.Count())
+
+	if fm.payloadFile != nil {
+		_, err := fm.payloadFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = io.Copy(w, fm.payloadFile)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else if fm.payload.Len() > 0 {
+		_, err := w.Write(fm.payload.Bytes())
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if m.bufMaxVarintLen64 == nil {
+		m.bufMaxVarintLen64 = make([]byte, binary.MaxVarintLen64)
+	}
+	buf := m.bufMaxVarintLen64
+
+	var vellumBuf bytes.Buffer
+	newVellum, err := vellum.New(&vellumBuf, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, t := range fm.terms {
+		var postingsOffset uint64
+		if t.oneHit {
+			postingsOffset = t.val
+		} else {
+			postingsOffset = uint64(w.Count())
+
+			n := binary.PutUvarint(buf, payloadBase+t.tfOffset)
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return 0, 0, err
+			}
+
+			n = binary.PutUvarint(buf, payloadBase+t.locOffset)
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return 0, 0, err
+			}
+
+			_, err = w.Write(t.roaring)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		err = newVellum.Insert(t.term, postingsOffset)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	dictOffset := uint64(w.Count())
+
+	err = newVellum.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	vellumData := vellumBuf.Bytes()
+
+	n := binary.PutUvarint(buf, uint64(len(vellumData)))
+	_, err = w.Write(buf[:n])
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = w.Write(vellumData)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	docValuesOffset := uint64(w.Count())
+	if fm.fdv.Len() > 0 {
+		_, err = w.Write(fm.fdv.Bytes())
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return dictOffset, docValuesOffset, nil
+}